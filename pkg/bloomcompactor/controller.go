@@ -0,0 +1,402 @@
+package bloomcompactor
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/grafana/loki/pkg/bloomcompactor/overlapcache"
+	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+	"github.com/grafana/loki/pkg/storage/stores/shipper/indexshipper/tsdb"
+)
+
+// MaxOverlappingBlocks is the default number of blocks allowed to cover the
+// same fingerprint sub-range, across tsdb generations, before a vertical
+// merge is planned to consolidate them into a single block.
+const MaxOverlappingBlocks = 3
+
+// Meta describes the tsdb sources and resulting blocks that cover a
+// particular fingerprint ownership range within a single compaction pass.
+type Meta struct {
+	OwnershipRange v1.FingerprintBounds
+	Sources        []tsdb.Identifier
+	Blocks         []BlockRef
+}
+
+// BlockRef uniquely identifies a bloom block and the fingerprint range it
+// covers.
+type BlockRef struct {
+	OwnershipRange v1.FingerprintBounds
+}
+
+// Bounds implements v1.BoundedItem, letting a BlockRef be swept directly by
+// v1.NewBoundsMergeIter.
+func (b BlockRef) Bounds() v1.FingerprintBounds { return b.OwnershipRange }
+
+// tsdbGaps holds the fingerprint ranges not yet covered by a block built
+// from the given tsdb, within the compactor's ownership range.
+type tsdbGaps struct {
+	tsdb tsdb.Identifier
+	gaps []v1.FingerprintBounds
+	// generation is the tsdb's position in the input tsdb list (newer
+	// tsdbs have a higher generation). gapsBetweenTSDBsAndMetas uses it,
+	// together with PlanOptions.MaxOOOGeneration, to decide whether a
+	// late-arriving tsdb is still worth planning for at all.
+	//
+	// Deliberately out of scope: arbitrating which of two tsdbs' blocks is
+	// "authoritative" for a fingerprint they both cover. BlockRef carries no
+	// provenance of its own (no tsdb id, no generation) -- it's addressed
+	// purely by the range it covers -- so there's no per-block data to rank
+	// by generation even if something consumed it. When two tsdbs disagree
+	// on overlapping ranges, both blocks are surfaced as candidates
+	// (Test_blockPlansForGaps_generationDoesNotArbitrateOverlappingBlocks)
+	// and planMerges consolidates the redundancy, rather than a tiebreak
+	// here picking one tsdb's block over the other's.
+	generation int
+}
+
+// PlanOptions configures gapsBetweenTSDBsAndMetas' tolerance for
+// out-of-order / late-arriving tsdbs, borrowing from the out-of-order
+// sample handling introduced in Prometheus TSDB.
+type PlanOptions struct {
+	// AllowOOO, when true, accepts a tsdb whose fingerprint range isn't
+	// currently covered by any meta instead of erroring: the whole
+	// ownership range is planned as a gap for that tsdb.
+	AllowOOO bool
+	// MaxOOOGeneration bounds how many generations behind the newest tsdb a
+	// late tsdb may be and still be planned for; tsdbs further behind than
+	// this are skipped entirely. 0 means unbounded. It only applies when
+	// AllowOOO is true.
+	MaxOOOGeneration int
+}
+
+// reclaimPlan marks a meta's blocks as candidates for deletion because every
+// tsdb that produced it is absent from the current tsdb list, i.e. its data
+// has necessarily been superseded elsewhere.
+type reclaimPlan struct {
+	meta   Meta
+	blocks []BlockRef
+}
+
+// gapWithBlocks pairs an uncovered fingerprint range with the existing blocks
+// (potentially built from other tsdbs) that can source its chunks, sparing a
+// full re-read of the underlying chunks.
+type gapWithBlocks struct {
+	bounds v1.FingerprintBounds
+	blocks []BlockRef
+}
+
+// mergePlan describes a vertical-compaction merge of multiple blocks, built
+// from different tsdb generations, that cover overlapping fingerprint
+// sub-ranges, to be consolidated into a single block. It records only the
+// blocks and their union bounds; no code in this package reads those blocks
+// or writes the merged block.
+type mergePlan struct {
+	bounds v1.FingerprintBounds
+	blocks []BlockRef
+}
+
+// blockPlan is the set of gaps that must be filled for a single tsdb and the
+// blocks already available to source data from for each gap. Vertical
+// merges aren't tied to any one tsdb, so they're returned by
+// blockPlansForGaps alongside the per-tsdb plans rather than attached here.
+type blockPlan struct {
+	tsdb tsdb.Identifier
+	gaps []gapWithBlocks
+}
+
+// fpBoundsItem adapts a raw FingerprintBounds to v1.BoundedItem so it can be
+// swept by v1.NewBoundsMergeIter.
+type fpBoundsItem v1.FingerprintBounds
+
+func (b fpBoundsItem) Bounds() v1.FingerprintBounds { return v1.FingerprintBounds(b) }
+
+// findGaps returns the sub-ranges of ownershipRange not covered by any of the
+// given metas. It errors when the metas' combined span, from the lowest Min
+// to the highest Max, doesn't overlap the ownership range at all, since that
+// signals the inputs don't belong to the same compaction. Metas lying on both
+// sides of the ownership range without touching it don't cause an error.
+func findGaps(ownershipRange v1.FingerprintBounds, metas []v1.FingerprintBounds) ([]v1.FingerprintBounds, error) {
+	if len(metas) == 0 {
+		return []v1.FingerprintBounds{ownershipRange}, nil
+	}
+
+	items := make([]v1.BoundedItem, len(metas))
+	for i, m := range metas {
+		items[i] = fpBoundsItem(m)
+	}
+
+	// sweep the metas into a sorted, non-overlapping set of ranges via Union
+	// (ranges that merely touch stay separate, since the sweep processes
+	// exits before enters), then check overlap with the ownership range
+	// using the same closed-interval arithmetic everywhere else relies on.
+	var merged []v1.FingerprintBounds
+	sweep := v1.NewBoundsMergeIter(items)
+	active := 0
+	var cur v1.FingerprintBounds
+	for sweep.Next() {
+		ev := sweep.At()
+		switch ev.Transition {
+		case v1.Enter:
+			if active == 0 {
+				cur = metas[ev.Index]
+			} else {
+				cur = cur.Union(metas[ev.Index])
+			}
+			active++
+		case v1.Exit:
+			active--
+			if active == 0 {
+				merged = append(merged, cur)
+			}
+		}
+	}
+
+	if !ownershipRange.OverlapsClosedInterval(merged[0].Min, merged[len(merged)-1].Max) {
+		return nil, fmt.Errorf("non-overlapping tsdbs and metas")
+	}
+
+	remaining := []v1.FingerprintBounds{ownershipRange}
+	for _, m := range merged {
+		var next []v1.FingerprintBounds
+		for _, r := range remaining {
+			next = append(next, r.Subtract(m)...)
+		}
+		remaining = next
+	}
+
+	return remaining, nil
+}
+
+// gapsBetweenTSDBsAndMetas determines, for each tsdb, the fingerprint ranges
+// within ownershipRange that aren't yet covered by a meta built from that
+// tsdb.
+func gapsBetweenTSDBsAndMetas(ownershipRange v1.FingerprintBounds, tsdbs []tsdb.Identifier, metas []Meta, opts PlanOptions) (res []tsdbGaps, err error) {
+	latestGeneration := len(tsdbs) - 1
+
+	for i, db := range tsdbs {
+		generation := i
+		if opts.AllowOOO && opts.MaxOOOGeneration > 0 && latestGeneration-generation > opts.MaxOOOGeneration {
+			// too far behind the newest tsdb to bother planning against;
+			// it'll be picked up (or reclaimed) on a later compaction.
+			continue
+		}
+
+		relevant := make([]v1.FingerprintBounds, 0, len(metas))
+		for _, meta := range metas {
+			for _, source := range meta.Sources {
+				if source.Name() == db.Name() {
+					relevant = append(relevant, meta.OwnershipRange)
+					break
+				}
+			}
+		}
+
+		gaps, gapErr := findGaps(ownershipRange, relevant)
+		if gapErr != nil {
+			if !opts.AllowOOO {
+				return nil, gapErr
+			}
+			// the tsdb's data isn't covered by any current meta at all;
+			// treat the whole ownership range as a gap rather than failing
+			// the entire compaction run over one late arrival.
+			gaps = []v1.FingerprintBounds{ownershipRange}
+		}
+		if len(gaps) == 0 {
+			continue
+		}
+
+		res = append(res, tsdbGaps{
+			tsdb:       db,
+			gaps:       gaps,
+			generation: generation,
+		})
+	}
+	return res, nil
+}
+
+// planReclaims finds metas whose Sources are all absent from the current
+// tsdb list and emits a reclaimPlan for each, so their blocks can be deleted
+// once nothing else still depends on them.
+func planReclaims(tsdbs []tsdb.Identifier, metas []Meta) []reclaimPlan {
+	current := make(map[string]struct{}, len(tsdbs))
+	for _, db := range tsdbs {
+		current[db.Name()] = struct{}{}
+	}
+
+	var reclaims []reclaimPlan
+	for _, meta := range metas {
+		if len(meta.Sources) == 0 {
+			continue
+		}
+
+		expired := true
+		for _, source := range meta.Sources {
+			if _, ok := current[source.Name()]; ok {
+				expired = false
+				break
+			}
+		}
+
+		if expired {
+			reclaims = append(reclaims, reclaimPlan{meta: meta, blocks: meta.Blocks})
+		}
+	}
+	return reclaims
+}
+
+// blockPlansForGaps is the entry point for a single compaction pass over a
+// tenant: it resolves, for each gap produced by gapsBetweenTSDBsAndMetas, the
+// existing blocks (built from any tsdb) that overlap it and can therefore
+// source chunks instead of re-reading them from the gap's tsdb; it returns
+// the vertical-merge plans for fingerprint ranges whose block count, across
+// tsdb generations, exceeds maxOverlappingBlocks and which aren't still
+// missing data for some tsdb (so merging doesn't need to wait on a gap fill
+// first) -- surfaced unconditionally, even when gaps is empty because every
+// tsdb is already fully caught up, since that's the steady-state case where
+// consolidating redundant blocks matters most; and it returns reclaim plans,
+// via planReclaims, for metas whose sources have all disappeared from tsdbs.
+func blockPlansForGaps(tsdbs []tsdb.Identifier, gaps []tsdbGaps, metas []Meta, maxOverlappingBlocks int) ([]blockPlan, []mergePlan, []reclaimPlan, error) {
+	allMerges := planMerges(metas, maxOverlappingBlocks)
+	reclaims := planReclaims(tsdbs, metas)
+
+	// Every gap, across every tsdb, is checked against the same set of
+	// blocks. Index them once per call instead of rescanning metas × blocks
+	// for each individual gap.
+	blocks := dedupedBlocks(metas)
+	byBounds := make(map[v1.FingerprintBounds]BlockRef, len(blocks))
+	bounds := make([]v1.FingerprintBounds, len(blocks))
+	for i, blk := range blocks {
+		byBounds[blk.OwnershipRange] = blk
+		bounds[i] = blk.OwnershipRange
+	}
+	blockIndex := overlapcache.Build(bounds, len(gaps))
+
+	plans := make([]blockPlan, 0, len(gaps))
+	var openGaps []v1.FingerprintBounds
+	for _, gap := range gaps {
+		plan := blockPlan{
+			tsdb: gap.tsdb,
+			gaps: make([]gapWithBlocks, 0, len(gap.gaps)),
+		}
+
+		for _, gapBounds := range gap.gaps {
+			matches := blockIndex.Intersecting(gapBounds)
+			var matched []BlockRef
+			for _, m := range matches {
+				matched = append(matched, byBounds[blockIndex.At(m.Index)])
+			}
+
+			plan.gaps = append(plan.gaps, gapWithBlocks{
+				bounds: gapBounds,
+				blocks: matched,
+			})
+		}
+
+		openGaps = append(openGaps, gap.gaps...)
+		plans = append(plans, plan)
+	}
+
+	merges := mergesNotBlockedByGaps(allMerges, openGaps)
+	return plans, merges, reclaims, nil
+}
+
+// dedupedBlocks flattens and deduplicates (by fingerprint range) the blocks
+// referenced across metas, preserving metas' iteration order.
+func dedupedBlocks(metas []Meta) []BlockRef {
+	seen := make(map[v1.FingerprintBounds]struct{})
+	var all []BlockRef
+	for _, meta := range metas {
+		for _, block := range meta.Blocks {
+			if _, ok := seen[block.OwnershipRange]; ok {
+				continue
+			}
+			seen[block.OwnershipRange] = struct{}{}
+			all = append(all, block)
+		}
+	}
+	return all
+}
+
+// planMerges groups the (deduped) blocks referenced by metas into connected
+// components of overlapping fingerprint ranges -- two blocks are in the same
+// component if they overlap directly, or transitively through a chain of
+// other overlapping blocks -- and emits a single mergePlan for every
+// component whose size exceeds maxOverlappingBlocks. It sweeps the blocks
+// once with v1.NewBoundsMergeIter rather than re-scanning forward from each
+// block, closing the current component only once the count of concurrently
+// active blocks drops back to zero, so a block can never end up claimed by
+// more than one mergePlan.
+func planMerges(metas []Meta, maxOverlappingBlocks int) []mergePlan {
+	all := dedupedBlocks(metas)
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].OwnershipRange.Less(all[j].OwnershipRange)
+	})
+
+	items := make([]v1.BoundedItem, len(all))
+	for i, b := range all {
+		items[i] = b
+	}
+
+	active := 0
+	var component []int
+	var merges []mergePlan
+
+	closeComponent := func() {
+		if len(component) > maxOverlappingBlocks {
+			plan := mergePlan{bounds: all[component[0]].OwnershipRange}
+			for _, i := range component {
+				plan.blocks = append(plan.blocks, all[i])
+				plan.bounds = plan.bounds.Union(all[i].OwnershipRange)
+			}
+			merges = append(merges, plan)
+		}
+		component = nil
+	}
+
+	enter := func(idx int) {
+		active++
+		component = append(component, idx)
+	}
+	exit := func() {
+		active--
+		if active == 0 {
+			closeComponent()
+		}
+	}
+
+	sweep := v1.NewBoundsMergeIter(items)
+	for sweep.Next() {
+		ev := sweep.At()
+		switch ev.Transition {
+		case v1.Enter:
+			enter(ev.Index)
+		case v1.Exit:
+			exit()
+		}
+	}
+
+	return merges
+}
+
+// mergesNotBlockedByGaps filters merges down to those whose union range
+// doesn't overlap any currently open gap, across any tsdb being planned for.
+// A merge overlapping an open gap is premature: the tsdb that still needs
+// that range will produce a new block there, which belongs in the merge too,
+// so consolidating the existing blocks now would have to be redone once the
+// gap is filled.
+func mergesNotBlockedByGaps(merges []mergePlan, gaps []v1.FingerprintBounds) []mergePlan {
+	var kept []mergePlan
+	for _, m := range merges {
+		blocked := false
+		for _, g := range gaps {
+			if m.bounds.Overlaps(g) {
+				blocked = true
+				break
+			}
+		}
+		if !blocked {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
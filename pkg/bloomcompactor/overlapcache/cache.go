@@ -0,0 +1,54 @@
+package overlapcache
+
+import v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+
+// Cache is a small fixed-capacity LRU keyed by query bounds, caching the
+// Match slice OverlapIndex.Intersecting resolved for that query the last
+// time it was asked. Planning re-issues the same handful of query bounds
+// (per-gap, per-tsdb) many times across a compaction run, so a tiny cache
+// goes a long way without the complexity of a general-purpose one.
+type Cache struct {
+	cap     int
+	entries map[v1.FingerprintBounds][]Match
+	order   []v1.FingerprintBounds
+}
+
+// NewCache returns a Cache holding at most capacity entries.
+func NewCache(capacity int) *Cache {
+	return &Cache{
+		cap:     capacity,
+		entries: make(map[v1.FingerprintBounds][]Match, capacity),
+	}
+}
+
+// Get returns the cached result for bounds, if present, and marks it most
+// recently used.
+func (c *Cache) Get(bounds v1.FingerprintBounds) ([]Match, bool) {
+	res, ok := c.entries[bounds]
+	if ok {
+		c.touch(bounds)
+	}
+	return res, ok
+}
+
+// Put stores the result for bounds, evicting the least-recently-used entry
+// if the cache is at capacity.
+func (c *Cache) Put(bounds v1.FingerprintBounds, matches []Match) {
+	if _, ok := c.entries[bounds]; !ok && len(c.order) >= c.cap {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		delete(c.entries, oldest)
+	}
+	c.entries[bounds] = matches
+	c.touch(bounds)
+}
+
+func (c *Cache) touch(bounds v1.FingerprintBounds) {
+	for i, b := range c.order {
+		if b == bounds {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, bounds)
+}
@@ -0,0 +1,119 @@
+// Package overlapcache speeds up repeated "which of these bounded ranges
+// intersect this query range" lookups against a fixed, already-known set --
+// blockPlansForGaps' hot path of matching every gap against the same set of
+// blocks when a tenant has many tsdbs and metas. It plays the same role
+// Pebble's per-file overlap cache plays for sstables: avoid re-scanning the
+// full set on every query.
+//
+// findGaps and gapsBetweenTSDBsAndMetas deliberately don't build an
+// OverlapIndex: their job is to merge the metas' own ranges into a
+// gap-free covered region (via v1.NewBoundsMergeIter's sweep), not to query
+// a fixed set with many different bounds, so there's no repeated-query
+// pattern here for an index to amortize.
+//
+// For the same reason, Meta and BlockRef don't carry their own OverlapCache
+// field -- they're plain value types copied by value throughout the
+// codebase (e.g. ranged over directly from []Meta), so a cache tied to one
+// copy's lifetime wouldn't see hits from another. Keeping the index and its
+// cache external and scoped to a single compaction run, as blockPlansForGaps
+// does via Build, avoids that without changing how Meta/BlockRef are
+// passed around elsewhere.
+package overlapcache
+
+import (
+	"sort"
+
+	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+)
+
+// Match is a single hit returned by Intersecting: the position of the
+// matching range in the index's sorted order, and whether bounds fully
+// contains it (as opposed to merely overlapping one edge).
+type Match struct {
+	Index          int
+	FullyContained bool
+}
+
+// OverlapIndex memoizes, for a fixed sorted set of bounded ranges (metas or
+// blocks), the subset that intersects an arbitrary query range. It's built
+// once per compaction run and queried once per gap/plan, replacing repeated
+// O(n) scans over the full input with a binary search plus a short scan.
+type OverlapIndex struct {
+	sorted   []v1.FingerprintBounds
+	maxSoFar []uint64 // maxSoFar[i] = max(Max) over sorted[:i+1]
+	cache    *Cache
+}
+
+// Build constructs an OverlapIndex over items, which need not be pre-sorted;
+// Build sorts a copy by Min fingerprint before indexing it. cacheSize is the
+// number of distinct query bounds whose results are memoized; 0 disables
+// caching.
+func Build(items []v1.FingerprintBounds, cacheSize int) *OverlapIndex {
+	sorted := make([]v1.FingerprintBounds, len(items))
+	copy(sorted, items)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Less(sorted[j])
+	})
+
+	maxSoFar := make([]uint64, len(sorted))
+	var running uint64
+	for i, b := range sorted {
+		if uint64(b.Max) > running {
+			running = uint64(b.Max)
+		}
+		maxSoFar[i] = running
+	}
+
+	var cache *Cache
+	if cacheSize > 0 {
+		cache = NewCache(cacheSize)
+	}
+
+	return &OverlapIndex{sorted: sorted, maxSoFar: maxSoFar, cache: cache}
+}
+
+// Len returns the number of ranges held by the index.
+func (idx *OverlapIndex) Len() int {
+	return len(idx.sorted)
+}
+
+// At returns the range at position i in the index's sorted order.
+func (idx *OverlapIndex) At(i int) v1.FingerprintBounds {
+	return idx.sorted[i]
+}
+
+// Intersecting returns every range in the index overlapping bounds, along
+// with whether bounds fully contains it. Results for a given bounds are
+// served from the index's LRU when present.
+func (idx *OverlapIndex) Intersecting(bounds v1.FingerprintBounds) []Match {
+	if idx.cache != nil {
+		if cached, ok := idx.cache.Get(bounds); ok {
+			return cached
+		}
+	}
+
+	// Every range before the first index whose running max reaches
+	// bounds.Min ends strictly before bounds starts, so it can't overlap.
+	lo := sort.Search(len(idx.maxSoFar), func(i int) bool {
+		return idx.maxSoFar[i] >= uint64(bounds.Min)
+	})
+
+	var res []Match
+	for i := lo; i < len(idx.sorted); i++ {
+		cur := idx.sorted[i]
+		if cur.Min > bounds.Max {
+			break
+		}
+		if cur.Overlaps(bounds) {
+			res = append(res, Match{
+				Index:          i,
+				FullyContained: bounds.Min <= cur.Min && cur.Max <= bounds.Max,
+			})
+		}
+	}
+
+	if idx.cache != nil {
+		idx.cache.Put(bounds, res)
+	}
+	return res
+}
@@ -0,0 +1,116 @@
+package overlapcache
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+)
+
+func Test_OverlapIndex_Intersecting(t *testing.T) {
+	items := []v1.FingerprintBounds{
+		v1.NewBounds(0, 5),
+		v1.NewBounds(4, 10),
+		v1.NewBounds(20, 30),
+	}
+
+	idx := Build(items, 0)
+
+	for _, tc := range []struct {
+		desc   string
+		bounds v1.FingerprintBounds
+		exp    []Match
+	}{
+		{
+			desc:   "no overlap",
+			bounds: v1.NewBounds(11, 19),
+			exp:    nil,
+		},
+		{
+			desc:   "overlaps first two",
+			bounds: v1.NewBounds(3, 4),
+			exp: []Match{
+				{Index: 0, FullyContained: false},
+				{Index: 1, FullyContained: false},
+			},
+		},
+		{
+			desc:   "fully contains last",
+			bounds: v1.NewBounds(15, 35),
+			exp: []Match{
+				{Index: 2, FullyContained: true},
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.exp, idx.Intersecting(tc.bounds))
+		})
+	}
+}
+
+func Test_OverlapIndex_cachesResults(t *testing.T) {
+	idx := Build([]v1.FingerprintBounds{v1.NewBounds(0, 10)}, 4)
+
+	bounds := v1.NewBounds(5, 15)
+	first := idx.Intersecting(bounds)
+	require.Len(t, first, 1)
+
+	cached, ok := idx.cache.Get(bounds)
+	require.True(t, ok)
+	require.Equal(t, first, cached)
+}
+
+func randomBounds(n int, maxFp int64) []v1.FingerprintBounds {
+	out := make([]v1.FingerprintBounds, n)
+	for i := range out {
+		min := model.Fingerprint(rand.Int63n(maxFp))
+		max := min + model.Fingerprint(rand.Int63n(maxFp/100+1))
+		out[i] = v1.NewBounds(min, max)
+	}
+	return out
+}
+
+func Benchmark_OverlapIndex_Intersecting(b *testing.B) {
+	const (
+		numMetas  = 10_000
+		numQuery  = 1_000
+		maxFp     = 1 << 32
+	)
+
+	metas := randomBounds(numMetas, maxFp)
+	queries := randomBounds(numQuery, maxFp)
+	idx := Build(metas, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, q := range queries {
+			_ = idx.Intersecting(q)
+		}
+	}
+}
+
+func Benchmark_LinearScan_Intersecting(b *testing.B) {
+	const (
+		numMetas = 10_000
+		numQuery = 1_000
+		maxFp    = 1 << 32
+	)
+
+	metas := randomBounds(numMetas, maxFp)
+	queries := randomBounds(numQuery, maxFp)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, q := range queries {
+			var matches []int
+			for j, m := range metas {
+				if m.Overlaps(q) {
+					matches = append(matches, j)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package v1
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+)
+
+// FingerprintBounds is a closed interval of fingerprints: [Min, Max].
+type FingerprintBounds struct {
+	Min, Max model.Fingerprint
+}
+
+// NewBounds returns a new FingerprintBounds spanning [min, max].
+func NewBounds(min, max model.Fingerprint) FingerprintBounds {
+	return FingerprintBounds{Min: min, Max: max}
+}
+
+func (b FingerprintBounds) String() string {
+	return fmt.Sprintf("%016x-%016x", uint64(b.Min), uint64(b.Max))
+}
+
+// Less orders bounds by their lower edge, then their upper edge. It's used to
+// sort bounds into a deterministic, non-overlapping-friendly order before
+// sweeping over them.
+func (b FingerprintBounds) Less(other FingerprintBounds) bool {
+	if b.Min != other.Min {
+		return b.Min < other.Min
+	}
+	return b.Max < other.Max
+}
+
+// Overlaps returns true if the two bounds share at least one fingerprint.
+func (b FingerprintBounds) Overlaps(other FingerprintBounds) bool {
+	return b.OverlapsClosedInterval(other.Min, other.Max)
+}
+
+// OverlapsClosedInterval returns true if b shares at least one fingerprint
+// with the closed interval [min, max].
+func (b FingerprintBounds) OverlapsClosedInterval(min, max model.Fingerprint) bool {
+	return b.Min <= max && min <= b.Max
+}
+
+// Intersect returns the overlapping sub-range of b and other, and whether
+// they overlap at all.
+func (b FingerprintBounds) Intersect(other FingerprintBounds) (FingerprintBounds, bool) {
+	if !b.Overlaps(other) {
+		return FingerprintBounds{}, false
+	}
+
+	min, max := b.Min, b.Max
+	if other.Min > min {
+		min = other.Min
+	}
+	if other.Max < max {
+		max = other.Max
+	}
+	return NewBounds(min, max), true
+}
+
+// Subtract removes other from b, returning the 0, 1 or 2 sub-ranges of b
+// left uncovered by other.
+func (b FingerprintBounds) Subtract(other FingerprintBounds) []FingerprintBounds {
+	if !b.Overlaps(other) {
+		return []FingerprintBounds{b}
+	}
+
+	var res []FingerprintBounds
+	if other.Min > b.Min {
+		res = append(res, NewBounds(b.Min, other.Min-1))
+	}
+	if other.Max < b.Max {
+		res = append(res, NewBounds(other.Max+1, b.Max))
+	}
+	return res
+}
+
+// Union returns the smallest range covering both b and other. Unlike
+// Overlaps, it doesn't check that the two are overlapping or adjacent --
+// callers that care should check that first.
+func (b FingerprintBounds) Union(other FingerprintBounds) FingerprintBounds {
+	min, max := b.Min, b.Max
+	if other.Min < min {
+		min = other.Min
+	}
+	if other.Max > max {
+		max = other.Max
+	}
+	return NewBounds(min, max)
+}
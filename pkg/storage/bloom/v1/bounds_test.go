@@ -0,0 +1,59 @@
+package v1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_FingerprintBounds_Intersect(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		a, b     FingerprintBounds
+		exp      FingerprintBounds
+		expFound bool
+	}{
+		{desc: "no overlap", a: NewBounds(0, 5), b: NewBounds(6, 10), expFound: false},
+		{desc: "partial overlap", a: NewBounds(0, 5), b: NewBounds(3, 10), exp: NewBounds(3, 5), expFound: true},
+		{desc: "containment", a: NewBounds(0, 10), b: NewBounds(3, 5), exp: NewBounds(3, 5), expFound: true},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, ok := tc.a.Intersect(tc.b)
+			require.Equal(t, tc.expFound, ok)
+			if ok {
+				require.Equal(t, tc.exp, got)
+			}
+		})
+	}
+}
+
+func Test_FingerprintBounds_Subtract(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		a, b FingerprintBounds
+		exp  []FingerprintBounds
+	}{
+		{desc: "no overlap", a: NewBounds(0, 5), b: NewBounds(6, 10), exp: []FingerprintBounds{NewBounds(0, 5)}},
+		{desc: "covers entirely", a: NewBounds(0, 5), b: NewBounds(0, 10), exp: nil},
+		{desc: "removes prefix", a: NewBounds(0, 10), b: NewBounds(0, 5), exp: []FingerprintBounds{NewBounds(6, 10)}},
+		{desc: "removes suffix", a: NewBounds(0, 10), b: NewBounds(5, 10), exp: []FingerprintBounds{NewBounds(0, 4)}},
+		{desc: "removes middle", a: NewBounds(0, 10), b: NewBounds(4, 6), exp: []FingerprintBounds{NewBounds(0, 3), NewBounds(7, 10)}},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.exp, tc.a.Subtract(tc.b))
+		})
+	}
+}
+
+func Test_FingerprintBounds_Union(t *testing.T) {
+	require.Equal(t, NewBounds(0, 10), NewBounds(0, 5).Union(NewBounds(4, 10)))
+	require.Equal(t, NewBounds(0, 10), NewBounds(4, 10).Union(NewBounds(0, 5)))
+}
+
+func Test_FingerprintBounds_OverlapsClosedInterval(t *testing.T) {
+	b := NewBounds(5, 10)
+	require.True(t, b.OverlapsClosedInterval(0, 5))
+	require.True(t, b.OverlapsClosedInterval(10, 20))
+	require.False(t, b.OverlapsClosedInterval(11, 20))
+	require.False(t, b.OverlapsClosedInterval(0, 4))
+}
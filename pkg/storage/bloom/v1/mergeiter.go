@@ -0,0 +1,98 @@
+package v1
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+// BoundedItem is anything with a fingerprint range -- metas, block refs,
+// gaps -- that BoundsMergeIter can sweep over.
+type BoundedItem interface {
+	Bounds() FingerprintBounds
+}
+
+// Transition is a sweep-line event kind emitted by BoundsMergeIter.
+type Transition uint8
+
+const (
+	// Enter fires at an item's lower bound.
+	Enter Transition = iota
+	// Exit fires just past an item's upper bound (i.e. at Max+1), so a
+	// caller tracking concurrently-active items can delete on Exit without
+	// an off-by-one. For an item whose range is a single fingerprint
+	// (Min == Max), Exit fires at Min+1, one position after its own Enter
+	// -- never bundled into the same event -- so that a concurrent Enter
+	// from another item sharing that fingerprint is always processed
+	// first and the two are seen as overlapping.
+	Exit
+)
+
+// Event pairs a sweep-line position with the transition occurring there and
+// the index, into the slice passed to NewBoundsMergeIter, of the item
+// causing it.
+type Event struct {
+	At         model.Fingerprint
+	Transition Transition
+	Index      int
+}
+
+// BoundsMergeIter walks a set of bounded items in fingerprint order and
+// emits the Enter/Exit transitions of a sweep-line algorithm. It unifies
+// what would otherwise be ad-hoc bounds arithmetic repeated across
+// findGaps-like planners, mirroring how Prometheus TSDB unified vertical and
+// non-vertical merging behind a single querier.
+type BoundsMergeIter struct {
+	events []Event
+	pos    int
+}
+
+// NewBoundsMergeIter builds a BoundsMergeIter over sources. Indices in the
+// emitted Events refer to positions in sources. Every item emits exactly one
+// Enter (at its Min) and one Exit (at its Max+1) -- even an item whose range
+// is a single fingerprint, whose Enter and Exit land one position apart
+// rather than being collapsed into one atomic event. That keeps the two
+// transitions resolvable by the tie-break below: collapsing them risked
+// closing out a caller's "currently active" set on that item's own Exit
+// before a concurrent Enter at the same position -- from another item
+// sharing that exact fingerprint -- was processed, splitting two
+// genuinely-overlapping items into separate runs.
+func NewBoundsMergeIter(sources []BoundedItem) *BoundsMergeIter {
+	events := make([]Event, 0, len(sources)*2)
+	for i, s := range sources {
+		b := s.Bounds()
+		events = append(events, Event{At: b.Min, Transition: Enter, Index: i})
+		events = append(events, Event{At: b.Max + 1, Transition: Exit, Index: i})
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].At != events[j].At {
+			return events[i].At < events[j].At
+		}
+		// at the same position, process exits before enters: a pair of
+		// ranges that merely touch (no shared fingerprint) shouldn't look,
+		// even momentarily, like they overlap.
+		return events[i].Transition == Exit && events[j].Transition != Exit
+	})
+
+	return &BoundsMergeIter{events: events}
+}
+
+// Next advances the iterator. It must be called before the first At().
+func (it *BoundsMergeIter) Next() bool {
+	if it.pos >= len(it.events) {
+		return false
+	}
+	it.pos++
+	return true
+}
+
+// At returns the current event. It's only valid after a call to Next that
+// returned true.
+func (it *BoundsMergeIter) At() Event {
+	return it.events[it.pos-1]
+}
+
+func (it *BoundsMergeIter) Err() error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package v1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type boundedFp FingerprintBounds
+
+func (b boundedFp) Bounds() FingerprintBounds { return FingerprintBounds(b) }
+
+func items(bounds ...FingerprintBounds) []BoundedItem {
+	out := make([]BoundedItem, len(bounds))
+	for i, b := range bounds {
+		out[i] = boundedFp(b)
+	}
+	return out
+}
+
+func drain(it *BoundsMergeIter) []Event {
+	var out []Event
+	for it.Next() {
+		out = append(out, it.At())
+	}
+	return out
+}
+
+func Test_BoundsMergeIter(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		bounds []FingerprintBounds
+		exp    []Event
+	}{
+		{
+			desc:   "single range",
+			bounds: []FingerprintBounds{NewBounds(0, 5)},
+			exp: []Event{
+				{At: 0, Transition: Enter, Index: 0},
+				{At: 6, Transition: Exit, Index: 0},
+			},
+		},
+		{
+			desc:   "single fingerprint still emits a separate enter and exit",
+			bounds: []FingerprintBounds{NewBounds(3, 3)},
+			exp: []Event{
+				{At: 3, Transition: Enter, Index: 0},
+				{At: 4, Transition: Exit, Index: 0},
+			},
+		},
+		{
+			// a single-fingerprint item's Enter and Exit must never collapse
+			// into one atomic event: a concurrent item entering at the same
+			// fingerprint has to be seen as overlapping it, not as arriving
+			// just after it closed.
+			desc:   "single fingerprint overlapping another range's start",
+			bounds: []FingerprintBounds{NewBounds(5, 5), NewBounds(5, 9)},
+			exp: []Event{
+				{At: 5, Transition: Enter, Index: 0},
+				{At: 5, Transition: Enter, Index: 1},
+				{At: 6, Transition: Exit, Index: 0},
+				{At: 10, Transition: Exit, Index: 1},
+			},
+		},
+		{
+			desc:   "touching ranges don't momentarily look overlapping",
+			bounds: []FingerprintBounds{NewBounds(0, 5), NewBounds(6, 10)},
+			exp: []Event{
+				{At: 0, Transition: Enter, Index: 0},
+				{At: 6, Transition: Exit, Index: 0},
+				{At: 6, Transition: Enter, Index: 1},
+				{At: 11, Transition: Exit, Index: 1},
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			it := NewBoundsMergeIter(items(tc.bounds...))
+			require.Equal(t, tc.exp, drain(it))
+		})
+	}
+}
@@ -1,7 +1,12 @@
 package v1
 
 import (
+	"fmt"
+	"strings"
+	"unicode"
 	"unicode/utf8"
+
+	"github.com/cespare/xxhash/v2"
 )
 
 const (
@@ -18,6 +23,30 @@ func reassemble(buf []rune, ln, pos int, result []byte) []byte {
 	return result
 }
 
+// Tokenizer splits a log line into the tokens used to populate (or query) a
+// bloom filter. Scheme() identifies the strategy a Tokenizer implements well
+// enough for ParseScheme to reconstruct a matching Tokenizer from it, so
+// whatever records a block's scheme (e.g. in its metadata) can hand the read
+// path back the same tokenization the block was built with. The one
+// exception is a WordTokenizer with a custom split function, which Scheme
+// doesn't record (see WordTokenizer.Scheme).
+type Tokenizer interface {
+	// Tokens returns an iterator over the tokens extracted from line. The
+	// []byte returned by the iterator's At() is not safe for use after
+	// subsequent calls to Next().
+	Tokens(line string) Iterator
+	// Scheme identifies the tokenization strategy, e.g. "ngram(4,0)".
+	Scheme() string
+}
+
+// Iterator is the interface satisfied by every tokenizer's iterator
+// (NGramTokenIter, EdgeNGramTokenIter, WordTokenIter, CompositeTokenIter, ...).
+type Iterator interface {
+	Next() bool
+	At() []byte
+	Err() error
+}
+
 // Iterable variants (more performant, less space)
 type NGramTokenizer struct {
 	N, Skip int
@@ -42,8 +71,8 @@ func NewNGramTokenizer(n, skip int) *NGramTokenizer {
 
 // The Token iterator uses shared buffers for performance. The []byte returned by At()
 // is not safe for use after subsequent calls to Next()
-func (t *NGramTokenizer) Tokens(line string) NGramTokenIter {
-	return NGramTokenIter{
+func (t *NGramTokenizer) Tokens(line string) Iterator {
+	return &NGramTokenIter{
 		n:    t.N,
 		skip: t.Skip,
 
@@ -54,6 +83,10 @@ func (t *NGramTokenizer) Tokens(line string) NGramTokenIter {
 	}
 }
 
+func (t *NGramTokenizer) Scheme() string {
+	return fmt.Sprintf("ngram(%d,%d)", t.N, t.Skip)
+}
+
 type NGramTokenIter struct {
 	n, skip int
 
@@ -97,17 +130,372 @@ type PrefixedTokenIter struct {
 	buf       []byte
 	prefixLen int
 
-	NGramTokenIter
+	Iterator
 }
 
 func (t *PrefixedTokenIter) At() []byte {
-	return append(t.buf[:t.prefixLen], t.NGramTokenIter.At()...)
+	return append(t.buf[:t.prefixLen], t.Iterator.At()...)
 }
 
-func NewPrefixedTokenIter(buf []byte, prefixLn int, iter NGramTokenIter) *PrefixedTokenIter {
+func NewPrefixedTokenIter(buf []byte, prefixLn int, iter Iterator) *PrefixedTokenIter {
 	return &PrefixedTokenIter{
-		buf:            buf,
-		prefixLen:      prefixLn,
-		NGramTokenIter: iter,
+		buf:       buf,
+		prefixLen: prefixLn,
+		Iterator:  iter,
+	}
+}
+
+// isWordRune reports whether r is part of a word for the purposes of
+// EdgeNGramTokenizer and the default WordTokenizer split function: letters,
+// digits and underscore.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// splitWords splits line into the maximal substrings for which isWordRune
+// returns true for every rune.
+func splitWords(line string, isWordRune func(rune) bool) []string {
+	var words []string
+	start := -1
+	for i, r := range line {
+		if isWordRune(r) {
+			if start == -1 {
+				start = i
+			}
+			continue
+		}
+		if start != -1 {
+			words = append(words, line[start:i])
+			start = -1
+		}
+	}
+	if start != -1 {
+		words = append(words, line[start:])
+	}
+	return words
+}
+
+// EdgeNGramTokenizer emits, for every word in a line (as delimited by
+// isWordRune), that word's prefixes of rune-length min..max. It suits prefix
+// queries over tokens that align with word boundaries -- paths, UUIDs, IPs,
+// quoted strings -- where fixed n-grams over-generate tokens for
+// high-cardinality text.
+type EdgeNGramTokenizer struct {
+	min, max int
+	buf      []rune // buffer used to decode the current word, reused across words
+	res      []byte // buffer used for token generation
+}
+
+func NewEdgeNGramTokenizer(min, max int) *EdgeNGramTokenizer {
+	return &EdgeNGramTokenizer{
+		min: min,
+		max: max,
+		buf: make([]rune, max),
+		res: make([]byte, 0, max*MaxRuneLen),
+	}
+}
+
+func (t *EdgeNGramTokenizer) Tokens(line string) Iterator {
+	return &EdgeNGramTokenIter{
+		min:      t.min,
+		max:      t.max,
+		words:    splitWords(line, isWordRune),
+		needWord: true,
+		cur:      t.buf,
+		res:      t.res,
+	}
+}
+
+func (t *EdgeNGramTokenizer) Scheme() string {
+	return fmt.Sprintf("edge_ngram(%d,%d)", t.min, t.max)
+}
+
+type EdgeNGramTokenIter struct {
+	min, max int
+	words    []string
+
+	wordIdx  int
+	cur      []rune // runes of the current word, capped at max and reused across words
+	curLen   int    // number of runes decoded into cur for the current word
+	needWord bool
+	prefix   int // rune length of the prefix last emitted for cur
+	res      []byte
+}
+
+func (t *EdgeNGramTokenIter) Next() bool {
+	for {
+		if t.needWord {
+			if t.wordIdx >= len(t.words) {
+				return false
+			}
+			t.curLen = 0
+			for _, r := range t.words[t.wordIdx] {
+				if t.curLen >= t.max {
+					break
+				}
+				t.cur[t.curLen] = r
+				t.curLen++
+			}
+			t.wordIdx++
+			t.prefix = 0
+			t.needWord = false
+		}
+
+		t.prefix++
+		if t.prefix > t.max || t.prefix > t.curLen {
+			t.needWord = true
+			continue
+		}
+		if t.prefix < t.min {
+			continue
+		}
+		return true
+	}
+}
+
+// The []byte returned by At() is not safe for use after subsequent calls to
+// Next(), matching NGramTokenIter's reusable-buffer semantics.
+func (t *EdgeNGramTokenIter) At() []byte {
+	return reassemble(t.cur, t.prefix, 0, t.res[:0])
+}
+
+func (t *EdgeNGramTokenIter) Err() error {
+	return nil
+}
+
+// WordTokenizer emits whole tokens, as delimited by splitOn, rather than
+// n-grams or prefixes. It pairs well with LowercaseFilter for case
+// insensitive full-token matches.
+type WordTokenizer struct {
+	splitOn func(rune) bool
+	res     []byte // buffer used for token generation
+}
+
+// NewWordTokenizer returns a WordTokenizer splitting on every rune for which
+// splitOn returns true. A nil splitOn defaults to splitting on anything that
+// isn't a letter, digit or underscore.
+func NewWordTokenizer(splitOn func(rune) bool) *WordTokenizer {
+	if splitOn == nil {
+		splitOn = func(r rune) bool { return !isWordRune(r) }
+	}
+	return &WordTokenizer{splitOn: splitOn, res: make([]byte, 0, 64)}
+}
+
+func (t *WordTokenizer) Tokens(line string) Iterator {
+	return &WordTokenIter{
+		words: splitWords(line, func(r rune) bool { return !t.splitOn(r) }),
+		res:   t.res,
+	}
+}
+
+// Scheme returns "word" whatever splitOn is: the split function isn't
+// recorded, so ParseScheme("word") returns a WordTokenizer that uses the
+// default split function.
+func (t *WordTokenizer) Scheme() string {
+	return "word"
+}
+
+type WordTokenIter struct {
+	words []string
+	idx   int
+	res   []byte
+}
+
+func (t *WordTokenIter) Next() bool {
+	if t.idx >= len(t.words) {
+		return false
+	}
+	t.idx++
+	return true
+}
+
+// The []byte returned by At() is not safe for use after subsequent calls to
+// Next(), matching NGramTokenIter's reusable-buffer semantics.
+func (t *WordTokenIter) At() []byte {
+	t.res = append(t.res[:0], t.words[t.idx-1]...)
+	return t.res
+}
+
+func (t *WordTokenIter) Err() error {
+	return nil
+}
+
+// LowercaseFilter wraps a Tokenizer, lowercasing (ASCII only) every token it
+// emits, so e.g. a WordTokenizer can be used for case-insensitive matching.
+type LowercaseFilter struct {
+	Tokenizer
+}
+
+func NewLowercaseFilter(t Tokenizer) *LowercaseFilter {
+	return &LowercaseFilter{Tokenizer: t}
+}
+
+func (t *LowercaseFilter) Tokens(line string) Iterator {
+	return &lowercaseIter{Iterator: t.Tokenizer.Tokens(line)}
+}
+
+func (t *LowercaseFilter) Scheme() string {
+	return "lowercase(" + t.Tokenizer.Scheme() + ")"
+}
+
+type lowercaseIter struct {
+	Iterator
+	buf []byte
+}
+
+func (it *lowercaseIter) At() []byte {
+	it.buf = append(it.buf[:0], it.Iterator.At()...)
+	for i, b := range it.buf {
+		if b >= 'A' && b <= 'Z' {
+			it.buf[i] = b + ('a' - 'A')
+		}
+	}
+	return it.buf
+}
+
+// CompositeTokenizer fans a line out through multiple Tokenizers, deduping
+// the tokens they emit (by xxhash of the token bytes) so composing several
+// schemes doesn't insert, or count, a token more than once per line.
+type CompositeTokenizer struct {
+	tokenizers []Tokenizer
+}
+
+func NewCompositeTokenizer(tokenizers ...Tokenizer) *CompositeTokenizer {
+	return &CompositeTokenizer{tokenizers: tokenizers}
+}
+
+func (t *CompositeTokenizer) Tokens(line string) Iterator {
+	iters := make([]Iterator, 0, len(t.tokenizers))
+	for _, tok := range t.tokenizers {
+		iters = append(iters, tok.Tokens(line))
+	}
+	return &CompositeTokenIter{
+		iters: iters,
+		seen:  make(map[uint64]struct{}, 64),
+	}
+}
+
+func (t *CompositeTokenizer) Scheme() string {
+	schemes := make([]string, 0, len(t.tokenizers))
+	for _, tok := range t.tokenizers {
+		schemes = append(schemes, tok.Scheme())
+	}
+	return "composite(" + strings.Join(schemes, ",") + ")"
+}
+
+type CompositeTokenIter struct {
+	iters []Iterator
+	idx   int
+	seen  map[uint64]struct{}
+	cur   []byte
+}
+
+func (t *CompositeTokenIter) Next() bool {
+	for t.idx < len(t.iters) {
+		cur := t.iters[t.idx]
+		for cur.Next() {
+			tok := cur.At()
+			h := xxhash.Sum64(tok)
+			if _, ok := t.seen[h]; ok {
+				continue
+			}
+			t.seen[h] = struct{}{}
+			t.cur = tok
+			return true
+		}
+		t.idx++
+	}
+	return false
+}
+
+func (t *CompositeTokenIter) At() []byte {
+	return t.cur
+}
+
+func (t *CompositeTokenIter) Err() error {
+	for _, it := range t.iters {
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseScheme parses scheme, as returned by a Tokenizer's Scheme method,
+// back into a Tokenizer of the matching kind and configuration. It's the
+// inverse of Scheme(): reading it back out of wherever a block recorded it
+// lets the query path tokenize with the same scheme the block was built
+// with, rather than whatever tokenizer happens to be configured for writes.
+func ParseScheme(scheme string) (Tokenizer, error) {
+	switch {
+	case strings.HasPrefix(scheme, "ngram("):
+		var n, skip int
+		if _, err := fmt.Sscanf(scheme, "ngram(%d,%d)", &n, &skip); err != nil {
+			return nil, fmt.Errorf("invalid ngram scheme %q: %w", scheme, err)
+		}
+		return NewNGramTokenizer(n, skip), nil
+
+	case strings.HasPrefix(scheme, "edge_ngram("):
+		var min, max int
+		if _, err := fmt.Sscanf(scheme, "edge_ngram(%d,%d)", &min, &max); err != nil {
+			return nil, fmt.Errorf("invalid edge_ngram scheme %q: %w", scheme, err)
+		}
+		return NewEdgeNGramTokenizer(min, max), nil
+
+	case scheme == "word":
+		return NewWordTokenizer(nil), nil
+
+	case strings.HasPrefix(scheme, "lowercase(") && strings.HasSuffix(scheme, ")"):
+		inner, err := ParseScheme(scheme[len("lowercase(") : len(scheme)-1])
+		if err != nil {
+			return nil, err
+		}
+		return NewLowercaseFilter(inner), nil
+
+	case strings.HasPrefix(scheme, "composite(") && strings.HasSuffix(scheme, ")"):
+		parts, err := splitTopLevel(scheme[len("composite(") : len(scheme)-1])
+		if err != nil {
+			return nil, err
+		}
+		tokenizers := make([]Tokenizer, 0, len(parts))
+		for _, part := range parts {
+			tok, err := ParseScheme(part)
+			if err != nil {
+				return nil, err
+			}
+			tokenizers = append(tokenizers, tok)
+		}
+		return NewCompositeTokenizer(tokenizers...), nil
+
+	default:
+		return nil, fmt.Errorf("unrecognized tokenizer scheme %q", scheme)
+	}
+}
+
+// splitTopLevel splits a comma-separated list of nested Scheme() strings on
+// commas that aren't inside a nested pair of parens, so e.g.
+// "ngram(4,0),word" splits into two parts, not three.
+func splitTopLevel(s string) ([]string, error) {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced parens in scheme list %q", s)
+			}
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parens in scheme list %q", s)
 	}
+	return append(parts, s[start:]), nil
 }
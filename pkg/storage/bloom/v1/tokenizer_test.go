@@ -0,0 +1,96 @@
+package v1
+
+import (
+	"testing"
+	"unicode"
+
+	"github.com/stretchr/testify/require"
+)
+
+func collect(it Iterator) []string {
+	var out []string
+	for it.Next() {
+		out = append(out, string(it.At()))
+	}
+	return out
+}
+
+func Test_EdgeNGramTokenizer(t *testing.T) {
+	for _, tc := range []struct {
+		desc     string
+		min, max int
+		line     string
+		exp      []string
+	}{
+		{
+			desc: "single word",
+			min:  2, max: 4,
+			line: "foobar",
+			exp:  []string{"fo", "foo", "foob"},
+		},
+		{
+			desc: "multiple words",
+			min:  1, max: 2,
+			line: "ab cd",
+			exp:  []string{"a", "ab", "c", "cd"},
+		},
+		{
+			desc: "shorter than min is skipped",
+			min:  3, max: 5,
+			line: "ab",
+			exp:  nil,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			tok := NewEdgeNGramTokenizer(tc.min, tc.max)
+			require.Equal(t, tc.exp, collect(tok.Tokens(tc.line)))
+		})
+	}
+}
+
+func Test_WordTokenizer(t *testing.T) {
+	tok := NewWordTokenizer(nil)
+	require.Equal(t, []string{"foo", "bar", "baz"}, collect(tok.Tokens("foo bar/baz")))
+}
+
+func Test_LowercaseFilter(t *testing.T) {
+	tok := NewLowercaseFilter(NewWordTokenizer(nil))
+	require.Equal(t, []string{"foo", "bar"}, collect(tok.Tokens("FOO Bar")))
+}
+
+func Test_CompositeTokenizer_Dedupes(t *testing.T) {
+	tok := NewCompositeTokenizer(
+		NewWordTokenizer(nil),
+		NewWordTokenizer(func(r rune) bool { return unicode.IsSpace(r) }),
+	)
+
+	// both sub-tokenizers emit "foo" and "bar" for this line; the composite
+	// iterator should only emit each once.
+	require.Equal(t, []string{"foo", "bar"}, collect(tok.Tokens("foo bar")))
+}
+
+func Test_ParseScheme(t *testing.T) {
+	line := "foo bar/baz123"
+
+	for _, tok := range []Tokenizer{
+		NewNGramTokenizer(4, 0),
+		NewEdgeNGramTokenizer(2, 4),
+		NewWordTokenizer(nil),
+		NewLowercaseFilter(NewWordTokenizer(nil)),
+		NewCompositeTokenizer(NewNGramTokenizer(4, 0), NewWordTokenizer(nil)),
+	} {
+		t.Run(tok.Scheme(), func(t *testing.T) {
+			parsed, err := ParseScheme(tok.Scheme())
+			require.NoError(t, err)
+			require.Equal(t, tok.Scheme(), parsed.Scheme())
+			require.Equal(t, collect(tok.Tokens(line)), collect(parsed.Tokens(line)))
+		})
+	}
+}
+
+func Test_ParseScheme_Invalid(t *testing.T) {
+	for _, scheme := range []string{"", "ngram(4)", "bogus(1,2)", "composite(word"} {
+		_, err := ParseScheme(scheme)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,23 @@
+package tsdb
+
+import (
+	"fmt"
+	"time"
+)
+
+// Identifier uniquely identifies a tsdb index file, independent of where it's
+// stored.
+type Identifier interface {
+	Name() string
+}
+
+// SingleTenantTSDBIdentifier identifies a tsdb index built for a single
+// tenant, named after the timestamp at which it was built.
+type SingleTenantTSDBIdentifier struct {
+	TS time.Time
+}
+
+// Name implements Identifier.
+func (i SingleTenantTSDBIdentifier) Name() string {
+	return fmt.Sprintf("%d.tsdb", i.TS.Unix())
+}